@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	azureStorage "github.com/Azure/azure-sdk-for-go/storage"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// azureBoxStore is the original BoxStore backend, storing boxes and
+// manifests as blobs in an Azure Storage container.
+type azureBoxStore struct {
+	client    *azureStorage.BlobStorageClient
+	container string
+	parallel  int
+	chunkSize int64
+	ui        packer.Ui
+
+	accountName    string
+	accountKey     string
+	sasExpiry      time.Duration
+	sasPermissions string
+}
+
+func newAzureBoxStore(config *Config) (BoxStore, error) {
+	storageClient, err := azureStorage.NewBasicClient(config.StorageAccountName, config.AccessKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating storage client for storage account %q: %s", config.StorageAccountName, err)
+	}
+
+	var sasExpiry time.Duration
+	if config.SasExpiry != "" {
+		sasExpiry, err = time.ParseDuration(config.SasExpiry)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing sas_expiry %q: %s", config.SasExpiry, err)
+		}
+	}
+
+	sasPermissions := config.SasPermissions
+	if sasPermissions == "" {
+		sasPermissions = "r"
+	}
+
+	blobClient := storageClient.GetBlobService()
+	return &azureBoxStore{
+		client:         &blobClient,
+		container:      config.ContainerName,
+		parallel:       config.ParallelUpload,
+		chunkSize:      config.ChunkSize,
+		accountName:    config.StorageAccountName,
+		accountKey:     config.AccessKey,
+		sasExpiry:      sasExpiry,
+		sasPermissions: sasPermissions,
+	}, nil
+}
+
+func (s *azureBoxStore) SetUi(ui packer.Ui) {
+	s.ui = ui
+}
+
+// PublicURL returns the blob's URL. When sas_expiry is configured, the URL
+// is signed with a time-limited Shared Access Signature so the container
+// doesn't need to be publicly readable.
+func (s *azureBoxStore) PublicURL(path string) string {
+	base := s.client.GetBlobURL(s.container, path)
+	if s.sasExpiry <= 0 {
+		return base
+	}
+
+	sas, err := signSAS(s.accountName, s.accountKey, s.container, path, s.sasPermissions, time.Time{}, time.Now().Add(s.sasExpiry))
+	if err != nil {
+		s.message(fmt.Sprintf("Warning: failed to sign SAS URL for %s: %s", path, err))
+		return base
+	}
+	return base + "?" + sas
+}
+
+// PathFromURL strips this store's blob URL prefix and any query string
+// from a URL previously returned by PublicURL, recovering the blob path it
+// was generated for. It returns "" if url doesn't belong to this
+// container.
+func (s *azureBoxStore) PathFromURL(rawURL string) string {
+	base := s.client.GetBlobURL(s.container, "")
+	if !strings.HasPrefix(rawURL, base) {
+		return ""
+	}
+
+	path := strings.TrimPrefix(rawURL, base)
+	if q := strings.Index(path, "?"); q >= 0 {
+		path = path[:q]
+	}
+	return path
+}
+
+// Exists reports whether path already holds a blob whose x-ms-meta-sha256
+// metadata matches sha256, so a re-run can skip re-uploading an unchanged
+// box.
+func (s *azureBoxStore) Exists(path, sha256 string) (bool, error) {
+	if sha256 == "" {
+		return false, nil
+	}
+
+	props, err := s.client.GetBlobProperties(s.container, path)
+	if err != nil {
+		if storErr, ok := err.(azureStorage.AzureStorageServiceError); ok && storErr.Code == "BlobNotFound" {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return props.Metadata["sha256"] == sha256, nil
+}
+
+func (s *azureBoxStore) DeleteBox(path string) error {
+	return s.client.DeleteBlob(s.container, path, nil)
+}
+
+// ModifiedAt reads path's Last-Modified blob property, which Azure returns
+// as an RFC 1123 string rather than a parsed time.
+func (s *azureBoxStore) ModifiedAt(path string) (time.Time, error) {
+	props, err := s.client.GetBlobProperties(s.container, path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(http.TimeFormat, props.LastModified)
+}
+
+func (s *azureBoxStore) GetManifest(path string) (io.ReadCloser, error) {
+	blob, err := s.client.GetBlob(s.container, path)
+	if err != nil {
+		if storErr, ok := err.(azureStorage.AzureStorageServiceError); ok && storErr.Code == "BlobNotFound" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return blob, nil
+}
+
+func (s *azureBoxStore) PutManifest(path string, data []byte) error {
+	return s.client.CreateBlockBlobFromReader(
+		s.container,
+		path,
+		uint64(len(data)),
+		bytes.NewReader(data),
+		map[string]string{
+			"Content-Type": "application/json",
+		},
+	)
+}
+
+// GetManifestETag fetches the manifest at path along with its blob ETag, so
+// a later write can be made conditional on nothing else having changed it
+// in the meantime. A nil reader and empty etag together mean no manifest
+// exists yet at path.
+func (s *azureBoxStore) GetManifestETag(path string) (io.ReadCloser, string, error) {
+	props, err := s.client.GetBlobProperties(s.container, path)
+	if err != nil {
+		if storErr, ok := err.(azureStorage.AzureStorageServiceError); ok && storErr.Code == "BlobNotFound" {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	blob, err := s.client.GetBlob(s.container, path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return blob, props.Etag, nil
+}
+
+// PutManifestIfMatch writes data to path using an If-Match (or, for a new
+// manifest, If-None-Match: *) condition, so two concurrent runs uploading
+// different providers for the same version can't silently overwrite one
+// another's manifest entries. It returns errManifestConflict if the
+// condition fails.
+func (s *azureBoxStore) PutManifestIfMatch(path string, data []byte, etag string) error {
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+	if etag != "" {
+		headers["If-Match"] = etag
+	} else {
+		headers["If-None-Match"] = "*"
+	}
+
+	err := s.client.CreateBlockBlobFromReader(s.container, path, uint64(len(data)), bytes.NewReader(data), headers)
+	if err != nil {
+		if storErr, ok := err.(azureStorage.AzureStorageServiceError); ok && storErr.StatusCode == 412 {
+			return errManifestConflict
+		}
+		return err
+	}
+	return nil
+}
+
+// PutBox uploads r (which must support ReaderAt, such as the bytes.Reader
+// PostProcess passes over the box it already read) to path, splitting it
+// into fixed-size blocks uploaded
+// concurrently across a worker pool. Block IDs are derived from the block's
+// position so ordering is preserved when the final PutBlockList is
+// assembled, regardless of which order the blocks finish uploading in. If
+// path already has uncommitted blocks from a previous, interrupted run,
+// those blocks are skipped so the upload can resume. Each block's MD5 is
+// sent as its Content-MD5 header so Azure validates it server-side on
+// ingest, and once the blob is committed its whole-file Content-MD5 is
+// checked against info.MD5. info.SHA256 is recorded as blob metadata so a
+// later run can short-circuit via Exists.
+func (s *azureBoxStore) PutBox(path string, r io.Reader, size int64, info BoxUploadInfo) (string, error) {
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return "", fmt.Errorf("azure backend requires a seekable file to upload")
+	}
+
+	chunkSize := s.chunkSize
+	if chunkSize <= 0 || chunkSize > defaultChunkSize {
+		chunkSize = defaultChunkSize
+	}
+
+	parallel := s.parallel
+	if parallel <= 0 {
+		parallel = defaultParallelUpload
+	}
+
+	existing, err := s.uncommittedBlockIDs(path)
+	if err != nil {
+		return "", err
+	}
+	if len(existing) > 0 {
+		s.message(fmt.Sprintf("%s: resuming upload, %d block(s) already uploaded", path, len(existing)))
+	} else if err := s.client.CreateBlockBlob(s.container, path); err != nil {
+		return "", err
+	}
+
+	jobs := jobsForSize(size, chunkSize)
+
+	var uploaded int64
+	var mu sync.Mutex
+	errs := make([]error, len(jobs))
+
+	jobCh := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobCh {
+				job := jobs[idx]
+
+				if existing[job.id] {
+					mu.Lock()
+					uploaded += job.size
+					s.message(fmt.Sprintf("%s: uploaded %d/%d bytes (block already present)", path, uploaded, size))
+					mu.Unlock()
+					continue
+				}
+
+				data := make([]byte, job.size)
+				if _, err := ra.ReadAt(data, job.offset); err != nil && err != io.EOF {
+					errs[idx] = err
+					continue
+				}
+
+				blockMD5 := md5.Sum(data)
+				headers := map[string]string{
+					"Content-MD5": base64.StdEncoding.EncodeToString(blockMD5[:]),
+				}
+
+				err := retryWithBackoff(uploadMaxRetries, uploadBaseBackoff, func() error {
+					return s.client.PutBlockWithLength(s.container, path, job.id, uint64(len(data)), bytes.NewReader(data), headers)
+				})
+				if err != nil {
+					errs[idx] = err
+					continue
+				}
+
+				mu.Lock()
+				uploaded += job.size
+				s.message(fmt.Sprintf("%s: uploaded %d/%d bytes", path, uploaded, size))
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for idx := range jobs {
+		jobCh <- idx
+	}
+	close(jobCh)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return "", err
+		}
+	}
+
+	blockList := make([]azureStorage.Block, len(jobs))
+	for i, job := range jobs {
+		blockList[i] = azureStorage.Block{ID: job.id, Status: azureStorage.BlockStatusLatest}
+	}
+
+	// Put Block List doesn't derive the committed blob's whole-file
+	// Content-MD5 from the blocks that made it up, the same reason an S3
+	// multipart ETag isn't one either: it has to be handed over explicitly.
+	commitHeaders := map[string]string{}
+	if info.MD5 != "" {
+		commitHeaders["x-ms-blob-content-md5"] = info.MD5
+	}
+	if err := s.client.PutBlockList(s.container, path, blockList, commitHeaders); err != nil {
+		return "", err
+	}
+
+	props, err := s.client.GetBlobProperties(s.container, path)
+	if err != nil {
+		return "", err
+	}
+
+	if info.MD5 != "" && props.ContentMD5 != info.MD5 {
+		return "", fmt.Errorf("vagrant-azure: uploaded blob %s failed MD5 validation: expected %s, got %s", path, info.MD5, props.ContentMD5)
+	}
+
+	if info.SHA256 != "" {
+		if err := s.client.SetBlobMetadata(s.container, path, map[string]string{"sha256": info.SHA256}, nil); err != nil {
+			return "", err
+		}
+	}
+
+	return s.PublicURL(path), nil
+}
+
+// uncommittedBlockIDs returns the set of block IDs already uploaded for
+// path but not yet committed via PutBlockList, so a retried upload can skip
+// re-sending them.
+func (s *azureBoxStore) uncommittedBlockIDs(path string) (map[string]bool, error) {
+	list, err := s.client.GetBlockList(s.container, path, azureStorage.BlockListTypeUncommitted)
+	if err != nil {
+		if storErr, ok := err.(azureStorage.AzureStorageServiceError); ok && storErr.Code == "BlobNotFound" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	ids := make(map[string]bool, len(list.UncommittedBlocks))
+	for _, b := range list.UncommittedBlocks {
+		ids[b.Name] = true
+	}
+	return ids, nil
+}
+
+func (s *azureBoxStore) message(msg string) {
+	if s.ui != nil {
+		s.ui.Message(msg)
+	}
+}
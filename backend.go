@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// errManifestConflict is returned by a BoxStore's PutManifestIfMatch when
+// the manifest was modified since it was last fetched, so the caller can
+// retry with a fresh copy instead of clobbering the other writer's change.
+var errManifestConflict = errors.New("vagrant-azure: manifest was modified concurrently")
+
+// BoxUploadInfo carries checksums alongside a box upload so backends can
+// record them as metadata (for a later Exists dedup check) and, where the
+// backend supports it, validate the upload server-side.
+type BoxUploadInfo struct {
+	// SHA256 is the hex-encoded sha256 digest of the box file.
+	SHA256 string
+
+	// MD5 is the base64-encoded md5 digest of the box file, in the form
+	// Azure's Content-MD5 header expects.
+	MD5 string
+}
+
+// BoxStore abstracts the storage provider that boxes and their manifest are
+// uploaded to, so PostProcessor isn't hard-wired to Azure Blob Storage. The
+// backend to use is selected by Config.Backend.
+type BoxStore interface {
+	// PutBox uploads size bytes read from r to path and returns the URL it
+	// can be fetched back from. info's checksums are recorded as metadata
+	// where the backend supports it.
+	PutBox(path string, r io.Reader, size int64, info BoxUploadInfo) (url string, err error)
+
+	// Exists reports whether a box matching sha256 is already stored at
+	// path, so PostProcess can skip a redundant upload.
+	Exists(path, sha256 string) (bool, error)
+
+	// GetManifest fetches the manifest stored at path. The caller must
+	// close the returned reader. A nil reader and nil error together mean
+	// no manifest exists yet at path.
+	GetManifest(path string) (io.ReadCloser, error)
+
+	// PutManifest writes data to path, overwriting any existing manifest.
+	PutManifest(path string, data []byte) error
+
+	// PublicURL returns the URL path is reachable at, without making any
+	// network calls.
+	PublicURL(path string) string
+
+	// PathFromURL recovers the path a URL previously returned by PublicURL
+	// was generated for, or "" if url wasn't generated by this store. It's
+	// used to map a manifest entry's URL back to a box path for retention.
+	PathFromURL(url string) string
+
+	// DeleteBox removes the box stored at path.
+	DeleteBox(path string) error
+
+	// ModifiedAt returns when the box at path was last written, so a
+	// retention pass can decide whether it's aged out.
+	ModifiedAt(path string) (time.Time, error)
+
+	// SetUi gives the store a packer.Ui to report upload progress through,
+	// since one isn't available until PostProcess runs.
+	SetUi(ui packer.Ui)
+}
+
+// newBoxStore builds the BoxStore selected by config.Backend.
+func newBoxStore(config *Config) (BoxStore, error) {
+	switch config.Backend {
+	case "", "azure":
+		return newAzureBoxStore(config)
+	case "s3":
+		return newS3BoxStore(config)
+	case "gcs":
+		return newGCSBoxStore(config)
+	case "filesystem":
+		return newFilesystemBoxStore(config)
+	default:
+		return nil, fmt.Errorf("vagrant-azure: unknown backend %q", config.Backend)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// filesystemBoxStore is a BoxStore that writes boxes and manifests to a
+// local directory tree, for air-gapped environments or testing without
+// any cloud credentials.
+type filesystemBoxStore struct {
+	dir string
+	ui  packer.Ui
+}
+
+func newFilesystemBoxStore(config *Config) (BoxStore, error) {
+	if err := os.MkdirAll(config.FilesystemDir, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating filesystem backend directory %q: %s", config.FilesystemDir, err)
+	}
+
+	return &filesystemBoxStore{dir: config.FilesystemDir}, nil
+}
+
+func (s *filesystemBoxStore) SetUi(ui packer.Ui) {
+	s.ui = ui
+}
+
+func (s *filesystemBoxStore) path(p string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(p))
+}
+
+func (s *filesystemBoxStore) PublicURL(path string) string {
+	return "file://" + s.path(path)
+}
+
+// sha256Path returns the path of the sidecar file that records path's
+// sha256, used by Exists to short-circuit a re-upload.
+func (s *filesystemBoxStore) sha256Path(path string) string {
+	return s.path(path) + ".sha256"
+}
+
+// Exists reports whether path's sidecar sha256 file matches sha256, so a
+// re-run can skip re-copying an unchanged box.
+func (s *filesystemBoxStore) Exists(path, sha256 string) (bool, error) {
+	if sha256 == "" {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(s.sha256Path(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return strings.TrimSpace(string(data)) == sha256, nil
+}
+
+// PathFromURL recovers the path a URL previously returned by PublicURL was
+// generated for, or "" if url doesn't belong to this directory.
+func (s *filesystemBoxStore) PathFromURL(rawURL string) string {
+	base := "file://" + filepath.Clean(s.dir) + string(filepath.Separator)
+	if !strings.HasPrefix(rawURL, base) {
+		return ""
+	}
+	return filepath.ToSlash(strings.TrimPrefix(rawURL, base))
+}
+
+// DeleteBox removes path along with its sidecar sha256 file, so a deleted
+// box doesn't leave a stale checksum behind for Exists to match against.
+func (s *filesystemBoxStore) DeleteBox(path string) error {
+	if err := os.Remove(s.path(path)); err != nil {
+		return err
+	}
+	os.Remove(s.sha256Path(path))
+	return nil
+}
+
+func (s *filesystemBoxStore) ModifiedAt(path string) (time.Time, error) {
+	info, err := os.Stat(s.path(path))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// PutBox copies r to path and, if info.SHA256 is set, records it in a
+// sidecar file so a later run can short-circuit the upload via Exists.
+func (s *filesystemBoxStore) PutBox(path string, r io.Reader, size int64, info BoxUploadInfo) (string, error) {
+	dest := s.path(path)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if s.ui != nil {
+		s.ui.Message(fmt.Sprintf("Copying %d bytes to %s", size, dest))
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		return "", err
+	}
+
+	if info.SHA256 != "" {
+		if err := ioutil.WriteFile(s.sha256Path(path), []byte(info.SHA256), 0644); err != nil {
+			return "", err
+		}
+	}
+
+	return s.PublicURL(path), nil
+}
+
+func (s *filesystemBoxStore) GetManifest(path string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *filesystemBoxStore) PutManifest(path string, data []byte) error {
+	dest := s.path(path)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dest, data, 0644)
+}
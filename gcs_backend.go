@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// gcsBoxStore is a BoxStore backed by a Google Cloud Storage bucket.
+type gcsBoxStore struct {
+	client *storage.Client
+	bucket string
+	prefix string
+	ui     packer.Ui
+}
+
+func newGCSBoxStore(config *Config) (BoxStore, error) {
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("Error creating GCS client: %s", err)
+	}
+
+	return &gcsBoxStore{
+		client: client,
+		bucket: config.GCSBucket,
+		prefix: config.GCSPrefix,
+	}, nil
+}
+
+func (s *gcsBoxStore) SetUi(ui packer.Ui) {
+	s.ui = ui
+}
+
+func (s *gcsBoxStore) key(path string) string {
+	if s.prefix == "" {
+		return path
+	}
+	return s.prefix + "/" + path
+}
+
+func (s *gcsBoxStore) object(path string) *storage.ObjectHandle {
+	return s.client.Bucket(s.bucket).Object(s.key(path))
+}
+
+func (s *gcsBoxStore) PublicURL(path string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", s.bucket, s.key(path))
+}
+
+// PutBox uploads r to path, recording info.SHA256 as object metadata so a
+// later run can short-circuit the upload via Exists.
+func (s *gcsBoxStore) PutBox(path string, r io.Reader, size int64, info BoxUploadInfo) (string, error) {
+	if s.ui != nil {
+		s.ui.Message(fmt.Sprintf("Uploading %d bytes to gs://%s/%s", size, s.bucket, s.key(path)))
+	}
+
+	w := s.object(path).NewWriter(context.Background())
+	if info.SHA256 != "" {
+		w.Metadata = map[string]string{"sha256": info.SHA256}
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	return s.PublicURL(path), nil
+}
+
+// Exists reports whether path already holds an object whose sha256
+// metadata matches sha256, so a re-run can skip re-uploading an unchanged
+// box.
+func (s *gcsBoxStore) Exists(path, sha256 string) (bool, error) {
+	if sha256 == "" {
+		return false, nil
+	}
+
+	attrs, err := s.object(path).Attrs(context.Background())
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return attrs.Metadata["sha256"] == sha256, nil
+}
+
+// PathFromURL recovers the key a URL previously returned by PublicURL was
+// generated for, or "" if url doesn't belong to this bucket.
+func (s *gcsBoxStore) PathFromURL(rawURL string) string {
+	base := fmt.Sprintf("https://storage.googleapis.com/%s/", s.bucket)
+	if !strings.HasPrefix(rawURL, base) {
+		return ""
+	}
+
+	key := strings.TrimPrefix(rawURL, base)
+	if s.prefix != "" {
+		key = strings.TrimPrefix(key, s.prefix+"/")
+	}
+	return key
+}
+
+func (s *gcsBoxStore) DeleteBox(path string) error {
+	err := s.object(path).Delete(context.Background())
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return err
+}
+
+func (s *gcsBoxStore) ModifiedAt(path string) (time.Time, error) {
+	attrs, err := s.object(path).Attrs(context.Background())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return attrs.Updated, nil
+}
+
+func (s *gcsBoxStore) GetManifest(path string) (io.ReadCloser, error) {
+	r, err := s.object(path).NewReader(context.Background())
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *gcsBoxStore) PutManifest(path string, data []byte) error {
+	w := s.object(path).NewWriter(context.Background())
+	w.ContentType = "application/json"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
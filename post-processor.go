@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -10,33 +12,58 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
-	azureStorage "github.com/Azure/azure-sdk-for-go/storage"
-
-	"encoding/base64"
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/helper/config"
 	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/template/interpolate"
 )
 
+// manifestWriteRetries bounds how many times an optimistic-concurrency
+// manifest read-modify-write (adding providers, refreshing SAS tokens, or
+// pruning) is attempted before giving up on repeated conflicts.
+const manifestWriteRetries = 5
+
 type Config struct {
-	StorageAccountName  string `mapstructure:"storage_account_name"`
-	ContainerName       string `mapstructure:"container_name"`
-	AccessKey           string `mapstructure:"access_key"`
-	Key                 string `mapstructure:"key"`
-	ManifestPath        string `mapstructure:"manifest"`
-	BoxName             string `mapstructure:"box_name"`
-	BoxDir              string `mapstructure:"box_dir"`
-	Version             string `mapstructure:"version"`
+	Backend             string            `mapstructure:"backend"`
+	StorageAccountName  string            `mapstructure:"storage_account_name"`
+	ContainerName       string            `mapstructure:"container_name"`
+	AccessKey           string            `mapstructure:"access_key"`
+	Key                 string            `mapstructure:"key"`
+	ManifestPath        string            `mapstructure:"manifest"`
+	BoxName             string            `mapstructure:"box_name"`
+	BoxDir              string            `mapstructure:"box_dir"`
+	Version             string            `mapstructure:"version"`
+	ParallelUpload      int               `mapstructure:"parallel_upload"`
+	ChunkSize           int64             `mapstructure:"chunk_size"`
+	ProviderMap         map[string]string `mapstructure:"provider_map"`
+	SasExpiry           string            `mapstructure:"sas_expiry"`
+	SasPermissions      string            `mapstructure:"sas_permissions"`
+	SasRefresh          bool              `mapstructure:"sas_refresh"`
+	S3Bucket            string            `mapstructure:"s3_bucket"`
+	S3Region            string            `mapstructure:"s3_region"`
+	S3Prefix            string            `mapstructure:"s3_prefix"`
+	GCSBucket           string            `mapstructure:"gcs_bucket"`
+	GCSPrefix           string            `mapstructure:"gcs_prefix"`
+	FilesystemDir       string            `mapstructure:"filesystem_dir"`
+	KeepVersions        int               `mapstructure:"keep_versions"`
+	KeepDays            string            `mapstructure:"keep_days"`
+	RetentionDryRun     bool              `mapstructure:"retention_dry_run"`
 	common.PackerConfig `mapstructure:",squash"`
 
 	ctx interpolate.Context
 }
 
 type PostProcessor struct {
-	config     Config
-	blobClient *azureStorage.BlobStorageClient
+	config Config
+	store  BoxStore
+
+	// keepDays is keep_days parsed once up front, so a typo'd duration
+	// fails fast in Configure instead of surfacing only after a retention
+	// pass has already uploaded a box and written the manifest.
+	keepDays time.Duration
 }
 
 func (p *PostProcessor) Configure(raws ...interface{}) error {
@@ -51,16 +78,33 @@ func (p *PostProcessor) Configure(raws ...interface{}) error {
 		return err
 	}
 
+	if p.config.Backend == "" {
+		p.config.Backend = "azure"
+	}
+
 	errs := new(packer.MultiError)
 
-	// required configuration
+	// configuration required for every backend
 	templates := map[string]*string{
-		"storage_account_name": &p.config.StorageAccountName,
-		"container_name":       &p.config.ContainerName,
-		"access_key":           &p.config.AccessKey,
-		"manifest":             &p.config.ManifestPath,
-		"box_name":             &p.config.BoxName,
-		"box_dir":              &p.config.BoxDir,
+		"manifest": &p.config.ManifestPath,
+		"box_name": &p.config.BoxName,
+		"box_dir":  &p.config.BoxDir,
+	}
+
+	// configuration required by the selected backend
+	switch p.config.Backend {
+	case "azure":
+		templates["storage_account_name"] = &p.config.StorageAccountName
+		templates["container_name"] = &p.config.ContainerName
+		templates["access_key"] = &p.config.AccessKey
+	case "s3":
+		templates["s3_bucket"] = &p.config.S3Bucket
+	case "gcs":
+		templates["gcs_bucket"] = &p.config.GCSBucket
+	case "filesystem":
+		templates["filesystem_dir"] = &p.config.FilesystemDir
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("vagrant-azure: unknown backend %q", p.config.Backend))
 	}
 
 	for key, ptr := range templates {
@@ -77,182 +121,507 @@ func (p *PostProcessor) Configure(raws ...interface{}) error {
 		}
 	}
 
-	storageClient, err := azureStorage.NewBasicClient(p.config.StorageAccountName, p.config.AccessKey)
-	if err != nil {
-		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Error creating storage client for storage account %q: %s", p.config.StorageAccountName, err))
+	if p.config.KeepDays != "" {
+		d, err := time.ParseDuration(p.config.KeepDays)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Error parsing keep_days %q: %s", p.config.KeepDays, err))
+		} else {
+			p.keepDays = d
+		}
 	}
 
-	blobClient := storageClient.GetBlobService()
-	p.blobClient = &blobClient
-
 	if len(errs.Errors) > 0 {
 		return errs
 	}
 
+	store, err := newBoxStore(&p.config)
+	if err != nil {
+		return err
+	}
+	p.store = store
+
 	return nil
 }
 
+// boxUpload is the outcome of uploading a single .box file: either a
+// Provider ready to add to the manifest, or the error that stopped it.
+type boxUpload struct {
+	provider *Provider
+	err      error
+}
+
 func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
 	// Only accept input from the vagrant post-processor
 	//if artifact.BuilderId() != "mitchellh.post-processor.vagrant" {
 	//	return nil, false, fmt.Errorf("Unknown artifact type, requires box from vagrant post-processor: %s", artifact.BuilderId())
 	//}
 
-	// Assume there is only one .box file to upload
-	box := artifact.Files()[0]
-	if !strings.HasSuffix(box, ".box") {
+	var boxes []string
+	for _, f := range artifact.Files() {
+		if strings.HasSuffix(f, ".box") {
+			boxes = append(boxes, f)
+		}
+	}
+	if len(boxes) == 0 {
 		return nil, false, fmt.Errorf("Unknown files in artifact from vagrant post-processor: %s", artifact.Files())
 	}
 
-	provider := providerFromBuilderName(artifact.Id())
-	ui.Say(fmt.Sprintf("Preparing to upload box for '%s' provider to azure container '%s'", provider, p.config.ContainerName))
+	p.store.SetUi(ui)
 
-	// determine box size
-	boxStat, err := os.Stat(box)
-	if err != nil {
-		return nil, false, err
-	}
-	ui.Message(fmt.Sprintf("Box to upload: %s (%d bytes)", box, boxStat.Size()))
-
-	// determine version
+	// determine version once so every box in this run lands on the same one
 	version := p.config.Version
-
 	if version == "" {
+		var err error
 		version, err = p.determineVersion()
 		if err != nil {
 			return nil, false, err
 		}
-
 		ui.Message(fmt.Sprintf("No version defined, using %s as new version", version))
 	} else {
 		ui.Message(fmt.Sprintf("Using %s as new version", version))
 	}
 
-	// generate the path to store the box in azure
-	boxPath := fmt.Sprintf("%s/%s/%s", p.config.BoxDir, version, path.Base(box))
+	// upload every box in parallel
+	singleBox := len(boxes) == 1
+	uploads := make([]boxUpload, len(boxes))
+	var wg sync.WaitGroup
+	for i, box := range boxes {
+		wg.Add(1)
+		go func(i int, box string) {
+			defer wg.Done()
+			uploads[i] = p.uploadBoxFile(ui, box, version, artifact.Id(), singleBox)
+		}(i, box)
+	}
+	wg.Wait()
 
-	ui.Message("Generating checksum")
-	checksum, err := sum256(box)
-	if err != nil {
+	providers := make([]*Provider, 0, len(uploads))
+	for _, u := range uploads {
+		if u.err != nil {
+			return nil, false, u.err
+		}
+		providers = append(providers, u.provider)
+	}
+
+	ui.Message(fmt.Sprintf("Adding %d provider(s) to manifest version %s", len(providers), version))
+	if err := p.addProvidersToManifest(version, providers); err != nil {
 		return nil, false, err
 	}
-	ui.Message(fmt.Sprintf("Checksum is %s", checksum))
 
-	//upload the box to azure
-	ui.Message(fmt.Sprintf("Uploading box to azure: %s", boxPath))
-	err = p.uploadBox(box, boxPath)
+	if p.config.SasRefresh {
+		ui.Message("Refreshing SAS tokens for all manifest entries")
+		if err := p.refreshManifestSAS(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if p.config.KeepVersions > 0 || p.config.KeepDays != "" {
+		if err := p.pruneManifest(ui); err != nil {
+			return nil, false, err
+		}
+	}
 
+	return &Artifact{
+		Url: providers[0].Url,
+	}, true, nil
+}
+
+// uploadBoxFile uploads a single box file and returns the Provider entry it
+// should be recorded as in the manifest. If a box matching the same sha256
+// already exists at the target path, the upload is skipped entirely and
+// only the manifest entry is refreshed. artifactID and singleBox are
+// forwarded to providerForBox so a single-box artifact (the common case)
+// still gets its provider from Packer's own artifact.Id() rather than a
+// filename guess.
+func (p *PostProcessor) uploadBoxFile(ui packer.Ui, box, version, artifactID string, singleBox bool) boxUpload {
+	provider := providerForBox(box, artifactID, singleBox, p.config.ProviderMap)
+	ui.Say(fmt.Sprintf("Preparing to upload box for '%s' provider via the %q backend", provider, p.config.Backend))
+
+	boxStat, err := os.Stat(box)
 	if err != nil {
-		return nil, false, err
+		return boxUpload{err: err}
 	}
+	ui.Message(fmt.Sprintf("Box to upload: %s (%d bytes)", box, boxStat.Size()))
 
-	// get the latest manifest so we can add to it
-	ui.Message("Fetching latest manifest")
-	manifest, err := p.getManifest()
+	ui.Message("Generating checksum")
+	data, sha256sum, md5sum, err := readAndSumBox(box)
 	if err != nil {
-		return nil, false, err
+		return boxUpload{err: err}
 	}
+	ui.Message(fmt.Sprintf("Checksum is %s", sha256sum))
 
-	ui.Message(fmt.Sprintf("Adding %s %s box to manifest", provider, version))
+	boxPath := fmt.Sprintf("%s/%s/%s", p.config.BoxDir, version, path.Base(box))
 
-	url := p.blobClient.GetBlobURL(p.config.ContainerName, boxPath)
+	exists, err := p.store.Exists(boxPath, sha256sum)
+	if err != nil {
+		return boxUpload{err: err}
+	}
 
-	err = manifest.add(version, &Provider{
+	var url string
+	if exists {
+		ui.Message(fmt.Sprintf("Box already uploaded at %s, skipping upload and refreshing manifest entry", boxPath))
+		url = p.store.PublicURL(boxPath)
+	} else {
+		ui.Message(fmt.Sprintf("Uploading box: %s", boxPath))
+		url, err = p.store.PutBox(boxPath, bytes.NewReader(data), boxStat.Size(), BoxUploadInfo{SHA256: sha256sum, MD5: md5sum})
+		if err != nil {
+			return boxUpload{err: err}
+		}
+	}
+
+	return boxUpload{provider: &Provider{
 		Name:         provider,
 		Url:          url,
 		ChecksumType: "sha256",
-		Checksum:     checksum,
-	})
-	if err != nil {
-		return nil, false, err
+		Checksum:     sha256sum,
+	}}
+}
+
+// addProvidersToManifest fetches the manifest once, appends every provider
+// to version, and writes it back in a single putManifest call. On backends
+// that expose an ETag (currently just Azure), the fetch-append-write is
+// retried under optimistic concurrency so two concurrent Packer runs
+// uploading different providers for the same version don't clobber each
+// other's manifest entries.
+func (p *PostProcessor) addProvidersToManifest(version string, providers []*Provider) error {
+	type etagStore interface {
+		GetManifestETag(path string) (io.ReadCloser, string, error)
+		PutManifestIfMatch(path string, data []byte, etag string) error
 	}
 
-	ui.Message(fmt.Sprintf("Uploading the manifest: %s", p.config.ManifestPath))
-	if err := p.putManifest(manifest); err != nil {
-		return nil, false, err
+	store, ok := p.store.(etagStore)
+	if !ok {
+		manifest, err := p.getManifest()
+		if err != nil {
+			return err
+		}
+		for _, provider := range providers {
+			if err := manifest.add(version, provider); err != nil {
+				return err
+			}
+		}
+		return p.putManifest(manifest)
 	}
 
-	return &Artifact{
-		Url: p.blobClient.GetBlobURL(p.config.ContainerName, boxPath),
-	}, true, nil
-}
+	for attempt := 0; attempt < manifestWriteRetries; attempt++ {
+		blob, etag, err := store.GetManifestETag(p.config.ManifestPath)
+		if err != nil {
+			return err
+		}
 
-func (p *PostProcessor) determineVersion() (string, error) {
-	manifest, err := p.getManifest()
-	if err != nil {
-		return "", err
-	} else {
-		return manifest.getNextVersion(), nil
+		manifest := &Manifest{Name: p.config.BoxName}
+		if blob != nil {
+			err = json.NewDecoder(blob).Decode(manifest)
+			blob.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, provider := range providers {
+			if err := manifest.add(version, provider); err != nil {
+				return err
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(manifest); err != nil {
+			return err
+		}
+
+		err = store.PutManifestIfMatch(p.config.ManifestPath, buf.Bytes(), etag)
+		if err == errManifestConflict {
+			continue
+		}
+		return err
 	}
+
+	return fmt.Errorf("vagrant-azure: manifest update conflicted %d times in a row, giving up", manifestWriteRetries)
 }
 
-func putBlockBlob(b *azureStorage.BlobStorageClient, container, name string, blob io.Reader, chunkSize int) error {
-	if chunkSize <= 0 || chunkSize > azureStorage.MaxBlobBlockSize {
-		chunkSize = azureStorage.MaxBlobBlockSize
+// refreshManifestSAS rewrites every provider URL in the manifest with a
+// freshly signed SAS token, so links handed out previously don't silently
+// expire. It operates on the manifest's raw JSON rather than the Manifest
+// type so it only touches entries whose URL it recognizes as one of its
+// own blobs. The read-refresh-write is retried under the same
+// GetManifestETag/PutManifestIfMatch optimistic concurrency as
+// addProvidersToManifest, so running sas_refresh on a schedule alongside
+// normal uploads can't silently clobber a concurrent upload's manifest
+// entry.
+func (p *PostProcessor) refreshManifestSAS() error {
+	azureStore, ok := p.store.(*azureBoxStore)
+	if !ok || azureStore.sasExpiry <= 0 {
+		return nil
 	}
 
-	chunk := make([]byte, chunkSize)
-	n, err := blob.Read(chunk)
-	if err != nil && err != io.EOF {
+	for attempt := 0; attempt < manifestWriteRetries; attempt++ {
+		blob, etag, err := azureStore.GetManifestETag(p.config.ManifestPath)
+		if err != nil {
+			return err
+		}
+		if blob == nil {
+			return nil
+		}
+		doc, err := decodeManifestDoc(blob)
+		if err != nil {
+			return err
+		}
+
+		versions, _ := doc["versions"].([]interface{})
+		for _, v := range versions {
+			version, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			providers, _ := version["providers"].([]interface{})
+			for _, pr := range providers {
+				provider, ok := pr.(map[string]interface{})
+				if !ok {
+					continue
+				}
+
+				rawURL, _ := provider["url"].(string)
+				boxPath := azureStore.PathFromURL(rawURL)
+				if boxPath == "" {
+					continue
+				}
+				provider["url"] = azureStore.PublicURL(boxPath)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(doc); err != nil {
+			return err
+		}
+
+		err = azureStore.PutManifestIfMatch(p.config.ManifestPath, buf.Bytes(), etag)
+		if err == errManifestConflict {
+			continue
+		}
 		return err
 	}
 
-	blockList := []azureStorage.Block{}
+	return fmt.Errorf("vagrant-azure: manifest update conflicted %d times in a row while refreshing SAS tokens, giving up", manifestWriteRetries)
+}
+
+// pruneManifest trims versions beyond the retention window configured by
+// keep_versions and/or keep_days, deleting the pruned versions' box blobs
+// from the store. Like refreshManifestSAS, it operates on the manifest's
+// raw JSON rather than the Manifest type. A pruned version is dropped from
+// the manifest whole, but only boxes whose URL it recognizes as one of its
+// own are deleted from the store. On backends that
+// expose an ETag (currently just Azure), the read-prune-write is retried
+// under optimistic concurrency, the same as addProvidersToManifest, so a
+// retention pass can't silently clobber a concurrent upload's manifest
+// entry. A version is kept if it falls within the most recent keep_versions
+// entries, or if any of its boxes were modified more recently than
+// keep_days ago; everything else is pruned. Blob deletion is best-effort: a
+// failure is logged and the pass continues, but the pruned manifest is
+// always persisted. In retention_dry_run, nothing is deleted and the
+// manifest isn't rewritten; pruning decisions are only logged.
+func (p *PostProcessor) pruneManifest(ui packer.Ui) error {
+	var cutoff time.Time
+	if p.keepDays > 0 {
+		cutoff = time.Now().Add(-p.keepDays)
+	}
+
+	type etagStore interface {
+		GetManifestETag(path string) (io.ReadCloser, string, error)
+		PutManifestIfMatch(path string, data []byte, etag string) error
+	}
 
-	for blockNum := 0; ; blockNum++ {
-		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%011d", blockNum)))
-		data := chunk[:n]
-		err = b.PutBlock(container, name, id, data)
+	store, ok := p.store.(etagStore)
+	if !ok {
+		blob, err := p.store.GetManifest(p.config.ManifestPath)
+		if err != nil {
+			return err
+		}
+		if blob == nil {
+			return nil
+		}
+		doc, err := decodeManifestDoc(blob)
 		if err != nil {
 			return err
 		}
 
-		blockList = append(blockList, azureStorage.Block{ID: id, Status: azureStorage.BlockStatusLatest})
+		data, changed, err := p.pruneManifestDoc(ui, doc, cutoff)
+		if err != nil || !changed || p.config.RetentionDryRun {
+			return err
+		}
+		return p.store.PutManifest(p.config.ManifestPath, data)
+	}
 
-		// Read next block
-		n, err = blob.Read(chunk)
-		if err != nil && err != io.EOF {
+	for attempt := 0; attempt < manifestWriteRetries; attempt++ {
+		blob, etag, err := store.GetManifestETag(p.config.ManifestPath)
+		if err != nil {
 			return err
 		}
-		if err == io.EOF {
-			break
+		if blob == nil {
+			return nil
+		}
+		doc, err := decodeManifestDoc(blob)
+		if err != nil {
+			return err
 		}
+
+		data, changed, err := p.pruneManifestDoc(ui, doc, cutoff)
+		if err != nil {
+			return err
+		}
+		if !changed || p.config.RetentionDryRun {
+			return nil
+		}
+
+		err = store.PutManifestIfMatch(p.config.ManifestPath, data, etag)
+		if err == errManifestConflict {
+			continue
+		}
+		return err
 	}
 
-	return b.PutBlockList(container, name, blockList)
+	return fmt.Errorf("vagrant-azure: manifest update conflicted %d times in a row while pruning, giving up", manifestWriteRetries)
 }
 
-func (p *PostProcessor) uploadBox(box, boxPath string) error {
-	// open the file for reading
-	file, err := os.Open(box)
-	if err != nil {
-		return err
+// pruneManifestDoc decides which of doc's versions survive the retention
+// window and deletes the pruned versions' box blobs (skipped in
+// retention_dry_run, where deletions are only logged via ui). It returns
+// doc re-encoded with only the surviving versions; changed is false if
+// nothing needed pruning, in which case the caller shouldn't write
+// anything back.
+func (p *PostProcessor) pruneManifestDoc(ui packer.Ui, doc map[string]interface{}, cutoff time.Time) (data []byte, changed bool, err error) {
+	versions, _ := doc["versions"].([]interface{})
+	if len(versions) == 0 {
+		return nil, false, nil
 	}
-	defer file.Close()
 
-	err = p.blobClient.CreateBlockBlob(p.config.ContainerName, boxPath)
-	if err != nil {
-		return err
+	keep := make([]bool, len(versions))
+	if p.config.KeepVersions > 0 {
+		start := len(versions) - p.config.KeepVersions
+		if start < 0 {
+			start = 0
+		}
+		for i := start; i < len(versions); i++ {
+			keep[i] = true
+		}
+	}
+	if !cutoff.IsZero() {
+		for i, v := range versions {
+			if keep[i] {
+				continue
+			}
+			if version, ok := v.(map[string]interface{}); ok && p.versionModifiedAfter(version, cutoff) {
+				keep[i] = true
+			}
+		}
 	}
 
-	err = putBlockBlob(p.blobClient, p.config.ContainerName, boxPath, file, azureStorage.MaxBlobBlockSize)
+	var kept, pruned []interface{}
+	for i, v := range versions {
+		if keep[i] {
+			kept = append(kept, v)
+		} else {
+			pruned = append(pruned, v)
+		}
+	}
+	if len(pruned) == 0 {
+		return nil, false, nil
+	}
 
-	return err
-}
+	for _, v := range pruned {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		versionName, _ := version["version"].(string)
 
-func (p *PostProcessor) getManifest() (*Manifest, error) {
+		providers, _ := version["providers"].([]interface{})
+		for _, pr := range providers {
+			provider, ok := pr.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			rawURL, _ := provider["url"].(string)
+			boxPath := p.store.PathFromURL(rawURL)
+			if boxPath == "" {
+				continue
+			}
 
-	blob, err := p.blobClient.GetBlob(p.config.ContainerName, p.config.ManifestPath)
+			if p.config.RetentionDryRun {
+				ui.Message(fmt.Sprintf("Retention (dry run): would delete %s (version %s)", boxPath, versionName))
+				continue
+			}
 
-	if err != nil {
-		if storErr, ok := err.(azureStorage.AzureStorageServiceError); ok {
-			if storErr.Code == "BlobNotFound" {
-				return &Manifest{Name: p.config.BoxName}, nil
+			ui.Message(fmt.Sprintf("Retention: deleting %s (version %s)", boxPath, versionName))
+			if err := p.store.DeleteBox(boxPath); err != nil {
+				ui.Error(fmt.Sprintf("Retention: failed to delete %s: %s", boxPath, err))
 			}
 		}
-		return nil, err
 	}
 
+	doc["versions"] = kept
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(doc); err != nil {
+		return nil, true, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+// decodeManifestDoc closes blob and decodes it as a raw manifest document,
+// for callers that need to manipulate fields a typed Manifest doesn't
+// expose (e.g. a provider's raw url).
+func decodeManifestDoc(blob io.ReadCloser) (map[string]interface{}, error) {
+	defer blob.Close()
+	var doc map[string]interface{}
+	err := json.NewDecoder(blob).Decode(&doc)
+	return doc, err
+}
+
+// versionModifiedAfter reports whether any of version's boxes were last
+// modified after cutoff, so pruneManifest can keep recently-written
+// versions even once they've fallen out of the keep_versions window.
+func (p *PostProcessor) versionModifiedAfter(version map[string]interface{}, cutoff time.Time) bool {
+	providers, _ := version["providers"].([]interface{})
+	for _, pr := range providers {
+		provider, ok := pr.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		rawURL, _ := provider["url"].(string)
+		boxPath := p.store.PathFromURL(rawURL)
+		if boxPath == "" {
+			continue
+		}
+
+		modTime, err := p.store.ModifiedAt(boxPath)
+		if err != nil {
+			continue
+		}
+		if modTime.After(cutoff) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PostProcessor) determineVersion() (string, error) {
+	manifest, err := p.getManifest()
+	if err != nil {
+		return "", err
+	} else {
+		return manifest.getNextVersion(), nil
+	}
+}
+
+func (p *PostProcessor) getManifest() (*Manifest, error) {
+	blob, err := p.store.GetManifest(p.config.ManifestPath)
+	if err != nil {
+		return nil, err
+	}
+	if blob == nil {
+		return &Manifest{Name: p.config.BoxName}, nil
+	}
 	defer blob.Close()
 
 	manifest := &Manifest{}
@@ -264,40 +633,65 @@ func (p *PostProcessor) getManifest() (*Manifest, error) {
 
 func (p *PostProcessor) putManifest(manifest *Manifest) error {
 	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(manifest)
-	if err != nil {
+	if err := json.NewEncoder(&buf).Encode(manifest); err != nil {
 		return err
 	}
 
-	data := buf.String()
-
-	return p.blobClient.CreateBlockBlobFromReader(
-		p.config.ContainerName,
-		p.config.ManifestPath,
-		uint64(len(data)),
-		strings.NewReader(data),
-		map[string]string{
-			"Content-Type": "application/json",
-		},
-	)
+	return p.store.PutManifest(p.config.ManifestPath, buf.Bytes())
 }
 
-// calculates a sha256 checksum of the file
-func sum256(filePath string) (string, error) {
-	// open the file for reading
+// readAndSumBox reads filePath into memory once, computing its sha256 and
+// base64-encoded md5 digest in the same pass, and returns the bytes read
+// alongside them. PutBox upload callers pass the returned bytes straight
+// through rather than reopening filePath, so a multi-GB box is only ever
+// read off disk once per upload instead of once to checksum it and again
+// to upload it.
+func readAndSumBox(filePath string) (data []byte, sha256hex, md5base64 string, err error) {
 	file, err := os.Open(filePath)
-
 	if err != nil {
-		return "", err
+		return nil, "", "", err
 	}
-
 	defer file.Close()
 
-	h := sha256.New()
-	if _, err := io.Copy(h, file); err != nil {
-		return "", err
+	var buf bytes.Buffer
+	sha := sha256.New()
+	md := md5.New()
+	if _, err := io.Copy(io.MultiWriter(&buf, sha, md), file); err != nil {
+		return nil, "", "", err
+	}
+
+	return buf.Bytes(), hex.EncodeToString(sha.Sum(nil)), base64.StdEncoding.EncodeToString(md.Sum(nil)), nil
+}
+
+// providerForBox determines the vagrant provider name for a single box file
+// within an artifact. An explicit entry in provider_map, keyed by the box's
+// base filename, always wins. Otherwise, for a single-box artifact,
+// artifact.Id() is Packer's own reliable signal for which builder produced
+// it and is used directly; box filenames aren't a safe fallback there since
+// the Vagrant post-processor's default output filename, "package.box",
+// doesn't mention a provider at all. Only a genuinely multi-box artifact,
+// where artifactID can't disambiguate between boxes, falls back to
+// guessing from known substrings in the filename, and finally the filename
+// itself for anything unrecognized.
+func providerForBox(box, artifactID string, singleBox bool, providerMap map[string]string) string {
+	name := path.Base(box)
+
+	if mapped, ok := providerMap[name]; ok {
+		return mapped
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
+
+	if singleBox && artifactID != "" {
+		return providerFromBuilderName(artifactID)
+	}
+
+	lower := strings.ToLower(name)
+	for _, known := range []string{"virtualbox", "vmware", "hyperv", "parallels", "aws", "digitalocean", "docker"} {
+		if strings.Contains(lower, known) {
+			return providerFromBuilderName(known)
+		}
+	}
+
+	return providerFromBuilderName(strings.TrimSuffix(name, ".box"))
 }
 
 // converts a packer builder name to the corresponding vagrant provider
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// s3BoxStore is a BoxStore backed by an Amazon S3 bucket. Uploads go
+// through the AWS SDK's multipart upload manager, which already chunks and
+// retries large files, so there's no need to reimplement that here.
+type s3BoxStore struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+	region   string
+	ui       packer.Ui
+}
+
+func newS3BoxStore(config *Config) (BoxStore, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(config.S3Region)})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating S3 session: %s", err)
+	}
+
+	return &s3BoxStore{
+		client:   s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+		bucket:   config.S3Bucket,
+		prefix:   config.S3Prefix,
+		region:   config.S3Region,
+	}, nil
+}
+
+func (s *s3BoxStore) SetUi(ui packer.Ui) {
+	s.ui = ui
+}
+
+func (s *s3BoxStore) key(path string) string {
+	if s.prefix == "" {
+		return path
+	}
+	return s.prefix + "/" + path
+}
+
+func (s *s3BoxStore) PublicURL(path string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, s.key(path))
+}
+
+// PutBox uploads r to path, recording info.SHA256 as object metadata so a
+// later run can short-circuit the upload via Exists.
+func (s *s3BoxStore) PutBox(path string, r io.Reader, size int64, info BoxUploadInfo) (string, error) {
+	if s.ui != nil {
+		s.ui.Message(fmt.Sprintf("Uploading %d bytes to s3://%s/%s", size, s.bucket, s.key(path)))
+	}
+
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(path)),
+		Body:   r,
+	}
+	if info.SHA256 != "" {
+		input.Metadata = map[string]*string{"sha256": aws.String(info.SHA256)}
+	}
+
+	if _, err := s.uploader.Upload(input); err != nil {
+		return "", err
+	}
+
+	return s.PublicURL(path), nil
+}
+
+// Exists reports whether path already holds an object whose sha256
+// metadata matches sha256, so a re-run can skip re-uploading an unchanged
+// box.
+func (s *s3BoxStore) Exists(path, sha256 string) (bool, error) {
+	if sha256 == "" {
+		return false, nil
+	}
+
+	out, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(path)),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NotFound" {
+			return false, nil
+		}
+		return false, err
+	}
+
+	got := out.Metadata["sha256"]
+	return got != nil && *got == sha256, nil
+}
+
+// PathFromURL recovers the key a URL previously returned by PublicURL was
+// generated for, or "" if url doesn't belong to this bucket.
+func (s *s3BoxStore) PathFromURL(rawURL string) string {
+	base := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", s.bucket, s.region)
+	if !strings.HasPrefix(rawURL, base) {
+		return ""
+	}
+
+	key := strings.TrimPrefix(rawURL, base)
+	if s.prefix != "" {
+		key = strings.TrimPrefix(key, s.prefix+"/")
+	}
+	return key
+}
+
+func (s *s3BoxStore) DeleteBox(path string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(path)),
+	})
+	return err
+}
+
+// ModifiedAt returns path's object LastModified from a HeadObject call,
+// rather than paying for a full GetObject just to inspect metadata.
+func (s *s3BoxStore) ModifiedAt(path string) (time.Time, error) {
+	out, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(path)),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if out.LastModified == nil {
+		return time.Time{}, fmt.Errorf("vagrant-azure: no LastModified for %s", path)
+	}
+	return *out.LastModified, nil
+}
+
+func (s *s3BoxStore) GetManifest(path string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(path)),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3BoxStore) PutManifest(path string, data []byte) error {
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key(path)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
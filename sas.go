@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sasServiceVersion is the Azure Storage REST API version this SAS
+// implementation signs against.
+const sasServiceVersion = "2015-04-05"
+
+// signSAS computes an Azure Blob Service Shared Access Signature query
+// string for a single blob. It implements the signing algorithm directly
+// (HMAC-SHA256 over the canonicalized string-to-sign, as described in the
+// Azure Blob Service SAS spec) rather than depending on SDK helpers that
+// may not exist in the storage SDK version this post-processor is pinned
+// to.
+func signSAS(accountName, accountKey, container, blob, permissions string, start, expiry time.Time) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil {
+		return "", fmt.Errorf("Error decoding storage account key: %s", err)
+	}
+
+	canonicalizedResource := fmt.Sprintf("/blob/%s/%s/%s", accountName, container, blob)
+
+	signedStart := ""
+	if !start.IsZero() {
+		signedStart = formatSASTime(start)
+	}
+	signedExpiry := formatSASTime(expiry)
+
+	stringToSign := strings.Join([]string{
+		permissions,
+		signedStart,
+		signedExpiry,
+		canonicalizedResource,
+		"", // signed identifier
+		"", // signed IP
+		"", // signed protocol
+		sasServiceVersion,
+		"", // rscc - Cache-Control
+		"", // rscd - Content-Disposition
+		"", // rsce - Content-Encoding
+		"", // rscl - Content-Language
+		"", // rsct - Content-Type
+	}, "\n")
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	values := url.Values{}
+	values.Set("sv", sasServiceVersion)
+	values.Set("sr", "b")
+	values.Set("sp", permissions)
+	if signedStart != "" {
+		values.Set("st", signedStart)
+	}
+	values.Set("se", signedExpiry)
+	values.Set("sig", signature)
+
+	return values.Encode(), nil
+}
+
+// formatSASTime formats t the way the Azure SAS spec expects timestamps:
+// ISO 8601, truncated to seconds, UTC.
+func formatSASTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+
+	azureStorage "github.com/Azure/azure-sdk-for-go/storage"
+)
+
+const (
+	defaultChunkSize      = int64(azureStorage.MaxBlobBlockSize)
+	defaultParallelUpload = 4
+	uploadMaxRetries      = 5
+	uploadBaseBackoff     = 500 * time.Millisecond
+)
+
+// blockJob is a single block of a box file queued for upload.
+type blockJob struct {
+	id     string
+	offset int64
+	size   int64
+}
+
+// blockIDsForSize generates the ordered, zero-padded block IDs needed to
+// cover a file of the given size in chunkSize blocks. Encoding the index
+// rather than a random value keeps block IDs monotonically ordered so the
+// assembled PutBlockList matches the original byte ordering of the file.
+func blockIDsForSize(total, chunkSize int64) []string {
+	count := int((total + chunkSize - 1) / chunkSize)
+	if count == 0 {
+		count = 1
+	}
+	ids := make([]string, count)
+	for i := 0; i < count; i++ {
+		ids[i] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%011d", i)))
+	}
+	return ids
+}
+
+// jobsForSize lays out the blockJobs needed to cover a file of the given
+// size in chunkSize blocks, pairing each block ID with its byte range.
+func jobsForSize(total, chunkSize int64) []blockJob {
+	ids := blockIDsForSize(total, chunkSize)
+	jobs := make([]blockJob, len(ids))
+	for i, id := range ids {
+		offset := int64(i) * chunkSize
+		size := chunkSize
+		if remaining := total - offset; remaining < size {
+			size = remaining
+		}
+		jobs[i] = blockJob{id: id, offset: offset, size: size}
+	}
+	return jobs
+}
+
+// retryWithBackoff calls fn until it succeeds, fn returns a non-retryable
+// error, or maxAttempts is reached. Each retry waits an exponentially
+// increasing, jittered delay so transient Azure errors (throttling, 500s,
+// timeouts) don't immediately fail a multi-GB upload.
+func retryWithBackoff(maxAttempts int, base time.Duration, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if !isRetryableError(err) || attempt == maxAttempts-1 {
+			return err
+		}
+
+		backoff := time.Duration(float64(base) * math.Pow(2, float64(attempt)))
+		time.Sleep(backoff/2 + jitter(backoff/2))
+	}
+	return err
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(n.Int64())
+}
+
+// isRetryableError reports whether err looks like a transient condition
+// worth retrying, such as an Azure 500/503 response. Errors that aren't an
+// AzureStorageServiceError (e.g. network timeouts) are retried as well.
+func isRetryableError(err error) bool {
+	storErr, ok := err.(azureStorage.AzureStorageServiceError)
+	if !ok {
+		return true
+	}
+	switch storErr.StatusCode {
+	case 500, 503:
+		return true
+	default:
+		return false
+	}
+}